@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
@@ -25,8 +26,37 @@ type IdempotencyManager struct {
 	store  map[string]*IdempotencyRecord
 	maxAge time.Duration
 
+	// maxRecords caps how many records store may hold. Once exceeded, the
+	// least-recently-accessed evictable records are dropped (see evict).
+	// Zero means unbounded.
+	maxRecords int
+
+	// lastAccessedAt tracks, per key, the last time Check or Get observed
+	// the record. It drives LRU eviction and is kept separate from
+	// IdempotencyRecord since callers don't need (or get) it serialized.
+	lastAccessedAt map[string]time.Time
+
+	// evictedTotal counts records dropped by LRU eviction, surfaced via
+	// Collector.
+	evictedTotal int
+
 	// Optional callback when duplicates are detected
 	onDuplicate func(key string, record *IdempotencyRecord)
+
+	// Optional callback fired after Complete finalizes a record, used by
+	// Collector to observe per-operation attempt counts and latency.
+	onComplete func(record *IdempotencyRecord)
+
+	// dist, if set, is the authoritative distributed backend (see
+	// idempotency_distributed.go). When present, the map above is a
+	// write-through cache: Check reads from dist so every replica agrees on
+	// status (Get and the other queries read only the local map), and Start
+	// claims the lease via dist before updating the local copy. leaseTTL and heartbeatInterval configure how that
+	// lease is held while an operation runs.
+	dist              IdempotencyStore
+	leaseTTL          time.Duration
+	heartbeatInterval time.Duration
+	heartbeatStops    map[string]func()
 }
 
 // IdempotencyRecord tracks a single operation
@@ -132,26 +162,66 @@ type IdempotencyCheckResult struct {
 // MANAGER LIFECYCLE
 // =============================================================================
 
-// NewIdempotencyManager creates a new idempotency manager
-// maxAge specifies how long to keep records (default: 24 hours)
-func NewIdempotencyManager(maxAge time.Duration) *IdempotencyManager {
+// NewIdempotencyManager creates a new idempotency manager.
+// maxAge specifies how long to keep records (default: 24 hours).
+// maxRecords caps the number of records held at once; 0 means unbounded.
+// Once the cap is exceeded, the least-recently-accessed completed records
+// are evicted first (see evict) - a burst of unique, short-lived keys can't
+// grow the store without bound between Cleanup calls.
+func NewIdempotencyManager(maxAge time.Duration, maxRecords int) *IdempotencyManager {
 	if maxAge == 0 {
 		maxAge = 24 * time.Hour
 	}
 
 	return &IdempotencyManager{
-		store:  make(map[string]*IdempotencyRecord),
-		maxAge: maxAge,
+		store:          make(map[string]*IdempotencyRecord),
+		maxAge:         maxAge,
+		maxRecords:     maxRecords,
+		lastAccessedAt: make(map[string]time.Time),
 	}
 }
 
-// SetDuplicateCallback sets a callback for when duplicates are detected
+// NewIdempotencyManagerWithStore creates an IdempotencyManager that defers
+// to dist as the source of truth, using its own map only as a write-through
+// cache. Use this in a horizontally-scaled deployment so that two replicas
+// retrying the same operation can't both proceed: Start claims a lease in
+// dist (failing if another replica already holds it) and Check consults
+// dist directly rather than the local cache.
+//
+// leaseTTL bounds how long a claimed lease survives without a heartbeat;
+// heartbeatInterval should be comfortably shorter than leaseTTL (a common
+// rule of thumb is leaseTTL/3).
+func NewIdempotencyManagerWithStore(maxAge time.Duration, dist IdempotencyStore, leaseTTL, heartbeatInterval time.Duration) *IdempotencyManager {
+	m := NewIdempotencyManager(maxAge, 0)
+	m.dist = dist
+	m.leaseTTL = leaseTTL
+	m.heartbeatInterval = heartbeatInterval
+	m.heartbeatStops = make(map[string]func())
+	return m
+}
+
+// SetDuplicateCallback sets a callback for when duplicates are detected.
+// callback runs synchronously from Check; without a distributed store it
+// runs with the manager's lock held, so it must not call back into this
+// IdempotencyManager (Check, Start, Get, ...), or it will deadlock against
+// the non-reentrant mutex.
 func (m *IdempotencyManager) SetDuplicateCallback(callback func(key string, record *IdempotencyRecord)) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.onDuplicate = callback
 }
 
+// SetCompletionCallback sets a callback invoked after Complete finalizes a
+// record, with a copy of the finished record. Used by Collector to feed its
+// attempt-count and latency histograms. Like SetDuplicateCallback, callback
+// runs with the manager's lock held when there is no distributed store, and
+// must not call back into this IdempotencyManager.
+func (m *IdempotencyManager) SetCompletionCallback(callback func(record *IdempotencyRecord)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onComplete = callback
+}
+
 // =============================================================================
 // CORE OPERATIONS
 // =============================================================================
@@ -159,8 +229,12 @@ func (m *IdempotencyManager) SetDuplicateCallback(callback func(key string, reco
 // Check checks if an operation was already executed
 // Returns detailed information about whether to proceed
 func (m *IdempotencyManager) Check(key string, requestData interface{}) IdempotencyCheckResult {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	if m.dist != nil {
+		return m.checkDistributed(key, requestData)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	record, exists := m.store[key]
 	if !exists {
@@ -171,6 +245,8 @@ func (m *IdempotencyManager) Check(key string, requestData interface{}) Idempote
 		}
 	}
 
+	m.lastAccessedAt[key] = time.Now()
+
 	// Verify request hash matches
 	newHash := hashData(requestData)
 	if record.RequestHash != newHash {
@@ -191,26 +267,28 @@ func (m *IdempotencyManager) Check(key string, requestData interface{}) Idempote
 	}
 
 	// Record exists and matches - check status
+	var result IdempotencyCheckResult
 	switch record.Status {
 	case IdempotencyCompleted:
 		if record.Success {
-			return IdempotencyCheckResult{
+			result = IdempotencyCheckResult{
 				IsDuplicate:   true,
 				Record:        record,
 				ShouldProceed: false,
 				Reason:        "operation already completed successfully",
 			}
-		}
-		// Completed but failed - allow retry
-		return IdempotencyCheckResult{
-			IsDuplicate:   true,
-			Record:        record,
-			ShouldProceed: true,
-			Reason:        "previous attempt failed, retry allowed",
+		} else {
+			// Completed but failed - allow retry
+			result = IdempotencyCheckResult{
+				IsDuplicate:   true,
+				Record:        record,
+				ShouldProceed: true,
+				Reason:        "previous attempt failed, retry allowed",
+			}
 		}
 
 	case IdempotencyInProgress:
-		return IdempotencyCheckResult{
+		result = IdempotencyCheckResult{
 			IsDuplicate:   true,
 			Record:        record,
 			ShouldProceed: false,
@@ -218,7 +296,7 @@ func (m *IdempotencyManager) Check(key string, requestData interface{}) Idempote
 		}
 
 	case IdempotencyFailed:
-		return IdempotencyCheckResult{
+		result = IdempotencyCheckResult{
 			IsDuplicate:   true,
 			Record:        record,
 			ShouldProceed: true,
@@ -226,7 +304,7 @@ func (m *IdempotencyManager) Check(key string, requestData interface{}) Idempote
 		}
 
 	case IdempotencyRolledBack:
-		return IdempotencyCheckResult{
+		result = IdempotencyCheckResult{
 			IsDuplicate:   true,
 			Record:        record,
 			ShouldProceed: true,
@@ -234,17 +312,31 @@ func (m *IdempotencyManager) Check(key string, requestData interface{}) Idempote
 		}
 
 	default:
-		return IdempotencyCheckResult{
+		result = IdempotencyCheckResult{
 			IsDuplicate:   true,
 			Record:        record,
 			ShouldProceed: true,
 			Reason:        "unknown status, allowing retry",
 		}
 	}
+
+	if m.onDuplicate != nil {
+		m.onDuplicate(key, record)
+	}
+
+	return result
 }
 
-// Start marks an operation as started and returns the record
-func (m *IdempotencyManager) Start(key string, requestData interface{}) *IdempotencyRecord {
+// Start marks an operation as started and returns the record. When the
+// manager wraps a distributed store, Start claims the lease there first; it
+// returns the current holder's record together with ErrLeaseHeld if a live
+// lease is already held, and otherwise starts a heartbeat
+// goroutine that refreshes the lease until Complete is called.
+func (m *IdempotencyManager) Start(key string, requestData interface{}) (*IdempotencyRecord, error) {
+	if m.dist != nil {
+		return m.startDistributed(key, requestData)
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -258,7 +350,7 @@ func (m *IdempotencyManager) Start(key string, requestData interface{}) *Idempot
 		existing.AttemptNumber++
 		existing.CompletedAt = nil
 		existing.Error = ""
-		return existing
+		return existing, nil
 	}
 
 	// Create new record
@@ -275,11 +367,18 @@ func (m *IdempotencyManager) Start(key string, requestData interface{}) *Idempot
 	}
 
 	m.store[key] = record
-	return record
+	m.lastAccessedAt[key] = now
+	m.evict()
+	return record, nil
 }
 
 // Complete marks an operation as completed
 func (m *IdempotencyManager) Complete(key string, success bool, result interface{}, err error) {
+	if m.dist != nil {
+		m.completeDistributed(key, success, result, err)
+		return
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -303,10 +402,26 @@ func (m *IdempotencyManager) Complete(key string, success bool, result interface
 			record.Error = err.Error()
 		}
 	}
+
+	if m.onComplete != nil {
+		copy := *record
+		m.onComplete(&copy)
+	}
 }
 
-// RecordFileChange records a file change for an operation
+// RecordFileChange records a file change for an operation. When the manager
+// wraps a distributed store, this is persisted there first (and the local
+// cache updated from the result) so the applied-file-change state survives
+// the next Check/Start, which would otherwise overwrite the local copy from
+// dist and silently lose it.
 func (m *IdempotencyManager) RecordFileChange(key string, change FileChangeRecord) {
+	if m.dist != nil {
+		if record, err := m.dist.RecordFileChange(key, change); err == nil {
+			m.cacheRecord(key, record)
+		}
+		return
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -318,8 +433,16 @@ func (m *IdempotencyManager) RecordFileChange(key string, change FileChangeRecor
 	record.FileChanges = append(record.FileChanges, change)
 }
 
-// MarkFileChangeApplied marks a specific file change as applied
+// MarkFileChangeApplied marks a specific file change as applied. See
+// RecordFileChange for why this goes through dist first when one is set.
 func (m *IdempotencyManager) MarkFileChangeApplied(key string, path string) {
+	if m.dist != nil {
+		if record, err := m.dist.MarkFileChangeApplied(key, path); err == nil {
+			m.cacheRecord(key, record)
+		}
+		return
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -360,14 +483,16 @@ func (m *IdempotencyManager) SetMetadata(key string, metaKey string, metaValue s
 
 // Get retrieves an idempotency record by key
 func (m *IdempotencyManager) Get(key string) *IdempotencyRecord {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	record, exists := m.store[key]
 	if !exists {
 		return nil
 	}
 
+	m.lastAccessedAt[key] = time.Now()
+
 	// Return a copy
 	copy := *record
 	return &copy
@@ -429,6 +554,59 @@ func (m *IdempotencyManager) HasAppliedChanges(key string) bool {
 	return false
 }
 
+// =============================================================================
+// LRU EVICTION
+// =============================================================================
+
+// evict drops the least-recently-accessed evictable records until store is
+// back under maxRecords. Must be called with m.mu held. It never evicts
+// IdempotencyInProgress records or records with file changes that haven't
+// been applied yet - losing track of either would let a caller retry an
+// operation whose side effects are actually still pending or unknown.
+func (m *IdempotencyManager) evict() {
+	if m.maxRecords <= 0 || len(m.store) <= m.maxRecords {
+		return
+	}
+
+	type candidate struct {
+		key        string
+		accessedAt time.Time
+	}
+	var candidates []candidate
+	for key, record := range m.store {
+		if !isEvictable(record) {
+			continue
+		}
+		candidates = append(candidates, candidate{key: key, accessedAt: m.lastAccessedAt[key]})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].accessedAt.Before(candidates[j].accessedAt)
+	})
+
+	for _, c := range candidates {
+		if len(m.store) <= m.maxRecords {
+			break
+		}
+		delete(m.store, c.key)
+		delete(m.lastAccessedAt, c.key)
+		m.evictedTotal++
+	}
+}
+
+// isEvictable reports whether record is safe to drop under LRU pressure.
+func isEvictable(record *IdempotencyRecord) bool {
+	if record.Status == IdempotencyInProgress {
+		return false
+	}
+	for _, change := range record.FileChanges {
+		if !change.Applied {
+			return false
+		}
+	}
+	return true
+}
+
 // =============================================================================
 // CLEANUP
 // =============================================================================
@@ -444,6 +622,7 @@ func (m *IdempotencyManager) Cleanup() int {
 	for key, record := range m.store {
 		if record.CreatedAt.Before(cutoff) {
 			delete(m.store, key)
+			delete(m.lastAccessedAt, key)
 			removed++
 		}
 	}
@@ -451,20 +630,33 @@ func (m *IdempotencyManager) Cleanup() int {
 	return removed
 }
 
-// Remove removes a specific record
+// Remove removes a specific record. When the manager wraps a distributed
+// store, the authoritative record is deleted there too - otherwise the next
+// Check/Start would just re-fetch it from dist via cacheRecord and silently
+// resurrect it, which would defeat an operator force-clearing a stuck key.
 func (m *IdempotencyManager) Remove(key string) {
+	if m.dist != nil {
+		_ = m.dist.Delete(key)
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	delete(m.store, key)
+	delete(m.lastAccessedAt, key)
 }
 
-// Clear removes all records
+// Clear removes all records from the local cache. It does NOT touch a
+// configured distributed store: IdempotencyStore has no way to enumerate
+// every key it holds, so "wipe everything" isn't expressible against a
+// shared Redis/Postgres backend from here, let alone safely across replicas.
+// Use Remove for individual keys in a distributed deployment.
 func (m *IdempotencyManager) Clear() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	m.store = make(map[string]*IdempotencyRecord)
+	m.lastAccessedAt = make(map[string]time.Time)
 }
 
 // =============================================================================
@@ -0,0 +1,219 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// =============================================================================
+// REDIS BACKEND
+// =============================================================================
+//
+// DistributedStoreBackendRedis implements DistributedStoreBackend on top of
+// a Redis client. CompareAndStore is done via a single Lua script so the
+// read-compare-write is atomic from Redis's point of view, matching the
+// SET NX semantics the idempotency request calls for.
+//
+// =============================================================================
+
+// compareAndStoreScript implements CompareAndStore's contract: write ARGV[3]
+// for KEYS[1] only if the key's current value matches the expectation
+// encoded in ARGV[1]/ARGV[2] (ARGV[1] == "0" means "key must not exist").
+var compareAndStoreScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if ARGV[1] == '1' then
+	if current == false or current ~= ARGV[2] then
+		return 0
+	end
+else
+	if current ~= false then
+		return 0
+	end
+end
+redis.call('SET', KEYS[1], ARGV[3])
+return 1
+`)
+
+// DistributedStoreBackendRedis backs DistributedStore with Redis, using
+// SET NX (via compareAndStoreScript) to atomically claim a key.
+type DistributedStoreBackendRedis struct {
+	client *redis.Client
+}
+
+// NewDistributedStoreBackendRedis wraps an existing Redis client. The
+// caller owns the client's lifecycle (pooling, auth, TLS, etc).
+func NewDistributedStoreBackendRedis(client *redis.Client) *DistributedStoreBackendRedis {
+	return &DistributedStoreBackendRedis{client: client}
+}
+
+func (b *DistributedStoreBackendRedis) Load(key string) ([]byte, error) {
+	raw, err := b.client.Get(context.Background(), key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis GET %q: %w", key, err)
+	}
+	return raw, nil
+}
+
+func (b *DistributedStoreBackendRedis) CompareAndStore(key string, expected, data []byte) (bool, error) {
+	hasExpected := "0"
+	if expected != nil {
+		hasExpected = "1"
+	}
+
+	result, err := compareAndStoreScript.Run(context.Background(), b.client, []string{key}, hasExpected, expected, data).Int()
+	if err != nil {
+		return false, fmt.Errorf("redis CAS %q: %w", key, err)
+	}
+	return result == 1, nil
+}
+
+func (b *DistributedStoreBackendRedis) Delete(key string) error {
+	if err := b.client.Del(context.Background(), key).Err(); err != nil {
+		return fmt.Errorf("redis DEL %q: %w", key, err)
+	}
+	return nil
+}
+
+// idempotencyLeaseChannel is the Redis pub/sub channel RedisLeaseWaiter uses
+// to wake replicas blocked on a lease they don't hold.
+const idempotencyLeaseChannel = "plandex_idempotency_lease_events"
+
+// RedisLeaseWaiter implements LeaseWaiter over Redis pub/sub.
+type RedisLeaseWaiter struct {
+	client *redis.Client
+}
+
+// NewRedisLeaseWaiter wraps an existing Redis client for pub/sub.
+func NewRedisLeaseWaiter(client *redis.Client) *RedisLeaseWaiter {
+	return &RedisLeaseWaiter{client: client}
+}
+
+func (w *RedisLeaseWaiter) Publish(event IdempotencyLeaseEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encode lease event: %w", err)
+	}
+	if err := w.client.Publish(context.Background(), idempotencyLeaseChannel, payload).Err(); err != nil {
+		return fmt.Errorf("redis PUBLISH: %w", err)
+	}
+	return nil
+}
+
+func (w *RedisLeaseWaiter) Subscribe() (<-chan IdempotencyLeaseEvent, func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := w.client.Subscribe(ctx, idempotencyLeaseChannel)
+
+	events := make(chan IdempotencyLeaseEvent)
+	go func() {
+		defer close(events)
+		for msg := range sub.Channel() {
+			var event IdempotencyLeaseEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	unsubscribe := func() {
+		cancel()
+		_ = sub.Close()
+	}
+	return events, unsubscribe, nil
+}
+
+// =============================================================================
+// POSTGRES BACKEND
+// =============================================================================
+//
+// DistributedStoreBackendPostgres backs DistributedStore with a Postgres
+// table, using INSERT ... ON CONFLICT DO NOTHING to claim an unclaimed key
+// and a guarded UPDATE ... WHERE data = $expected to reclaim or refresh one
+// atomically.
+//
+// =============================================================================
+
+// idempotencyRecordsTable holds one row per idempotency key: the raw
+// distributedRecord JSON blob this package reads and writes. Callers are
+// expected to have migrated it:
+//
+//	CREATE TABLE idempotency_records (
+//	    key  TEXT PRIMARY KEY,
+//	    data BYTEA NOT NULL
+//	);
+const idempotencyRecordsTable = "idempotency_records"
+
+// DistributedStoreBackendPostgres backs DistributedStore with Postgres.
+type DistributedStoreBackendPostgres struct {
+	db *sql.DB
+}
+
+// NewDistributedStoreBackendPostgres wraps an existing *sql.DB. The caller
+// owns the connection pool's lifecycle and the idempotency_records table's
+// migration.
+func NewDistributedStoreBackendPostgres(db *sql.DB) *DistributedStoreBackendPostgres {
+	return &DistributedStoreBackendPostgres{db: db}
+}
+
+func (b *DistributedStoreBackendPostgres) Load(key string) ([]byte, error) {
+	var data []byte
+	query := fmt.Sprintf("SELECT data FROM %s WHERE key = $1", idempotencyRecordsTable)
+	err := b.db.QueryRow(query, key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("postgres select %q: %w", key, err)
+	}
+	return data, nil
+}
+
+func (b *DistributedStoreBackendPostgres) CompareAndStore(key string, expected, data []byte) (bool, error) {
+	var (
+		res sql.Result
+		err error
+	)
+
+	if expected == nil {
+		query := fmt.Sprintf(
+			"INSERT INTO %s (key, data) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING",
+			idempotencyRecordsTable,
+		)
+		res, err = b.db.Exec(query, key, data)
+	} else {
+		query := fmt.Sprintf(
+			"UPDATE %s SET data = $1 WHERE key = $2 AND data = $3",
+			idempotencyRecordsTable,
+		)
+		res, err = b.db.Exec(query, data, key, expected)
+	}
+	if err != nil {
+		return false, fmt.Errorf("postgres CAS %q: %w", key, err)
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("postgres CAS %q: %w", key, err)
+	}
+	return rows == 1, nil
+}
+
+func (b *DistributedStoreBackendPostgres) Delete(key string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE key = $1", idempotencyRecordsTable)
+	if _, err := b.db.Exec(query, key); err != nil {
+		return fmt.Errorf("postgres delete %q: %w", key, err)
+	}
+	return nil
+}
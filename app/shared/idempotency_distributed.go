@@ -0,0 +1,566 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// =============================================================================
+// DISTRIBUTED STORE
+// =============================================================================
+//
+// DistributedStore implements IdempotencyStore on top of a shared backend
+// (Redis, Postgres, ...) so that every server replica sees the same lease
+// state for a given key. The backend only needs to support an atomic
+// compare-and-store primitive - DistributedStoreBackendRedis maps that onto
+// a Lua script around SET NX / SET XX, DistributedStoreBackendPostgres maps
+// it onto INSERT ... ON CONFLICT DO NOTHING / UPDATE ... WHERE.
+//
+// Claim holds a lease (LeaseExpiresAt) rather than claiming the key
+// forever, so a replica that crashes mid-operation doesn't wedge the key:
+// once the lease expires, the next Claim reclaims it and starts a fresh
+// IdempotencyInProgress attempt with AttemptNumber incremented. The
+// abandoned attempt is not stored as IdempotencyFailed, and no error is
+// kept for it.
+//
+// =============================================================================
+
+// DistributedStoreBackend is the minimal primitive DistributedStore needs
+// from the underlying datastore. DistributedStoreBackendRedis and
+// DistributedStoreBackendPostgres (idempotency_backends.go) implement it.
+type DistributedStoreBackend interface {
+	// Load returns the raw bytes currently stored for key, or nil if the
+	// key does not exist.
+	Load(key string) ([]byte, error)
+
+	// CompareAndStore atomically writes data for key, but only if the bytes
+	// currently stored for key equal expected. expected == nil means "key
+	// must not currently exist" (SET NX / INSERT ... ON CONFLICT DO
+	// NOTHING). Returns false, without error, if the comparison failed.
+	CompareAndStore(key string, expected, data []byte) (bool, error)
+
+	// Delete removes key unconditionally.
+	Delete(key string) error
+}
+
+// distributedRecord is the envelope persisted in the backend: the record
+// itself plus the lease bookkeeping that isn't part of IdempotencyRecord.
+type distributedRecord struct {
+	Record         *IdempotencyRecord `json:"record"`
+	LeaseExpiresAt time.Time          `json:"leaseExpiresAt"`
+}
+
+func (d *distributedRecord) leaseExpired(now time.Time) bool {
+	return d.LeaseExpiresAt.IsZero() || now.After(d.LeaseExpiresAt)
+}
+
+// DistributedStore is an IdempotencyStore backed by a shared datastore, for
+// deployments running more than one server replica.
+type DistributedStore struct {
+	backend DistributedStoreBackend
+	waiter  LeaseWaiter // optional; nil disables pub/sub wakeups
+
+	// claimRetries bounds how many times Claim retries its CAS loop when it
+	// races another caller claiming the same key at the same instant.
+	claimRetries int
+}
+
+// NewDistributedStore creates a DistributedStore over backend. waiter may be
+// nil, in which case WaitForCompletion falls back to polling Get.
+func NewDistributedStore(backend DistributedStoreBackend, waiter LeaseWaiter) *DistributedStore {
+	return &DistributedStore{
+		backend:      backend,
+		waiter:       waiter,
+		claimRetries: 5,
+	}
+}
+
+// Get returns the authoritative record for key across all replicas.
+func (s *DistributedStore) Get(key string) (*IdempotencyRecord, error) {
+	raw, err := s.backend.Load(key)
+	if err != nil {
+		return nil, fmt.Errorf("idempotency: load %q: %w", key, err)
+	}
+	if raw == nil {
+		return nil, nil
+	}
+
+	dr, err := decodeDistributedRecord(raw)
+	if err != nil {
+		return nil, err
+	}
+	return dr.Record, nil
+}
+
+// Claim atomically takes the lease for key. If the key is unclaimed, or the
+// previous lease has expired, it installs a fresh IdempotencyInProgress
+// record and returns it. If another replica holds a live lease, it returns
+// that record and ErrLeaseHeld.
+func (s *DistributedStore) Claim(key string, requestData interface{}, leaseTTL time.Duration) (*IdempotencyRecord, error) {
+	for attempt := 0; attempt < s.claimRetries; attempt++ {
+		raw, err := s.backend.Load(key)
+		if err != nil {
+			return nil, fmt.Errorf("idempotency: load %q: %w", key, err)
+		}
+
+		now := time.Now()
+
+		var existing *distributedRecord
+		if raw != nil {
+			existing, err = decodeDistributedRecord(raw)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if existing != nil && existing.Record.Status == IdempotencyInProgress && !existing.leaseExpired(now) {
+			return existing.Record, ErrLeaseHeld
+		}
+
+		next := s.buildClaim(existing, key, requestData, now, leaseTTL)
+		nextBytes, err := json.Marshal(next)
+		if err != nil {
+			return nil, fmt.Errorf("idempotency: encode %q: %w", key, err)
+		}
+
+		ok, err := s.backend.CompareAndStore(key, raw, nextBytes)
+		if err != nil {
+			return nil, fmt.Errorf("idempotency: claim %q: %w", key, err)
+		}
+		if ok {
+			return next.Record, nil
+		}
+		// Lost the race (another replica wrote between Load and
+		// CompareAndStore) - reload and retry.
+	}
+
+	return nil, fmt.Errorf("idempotency: claim %q: exhausted retries", key)
+}
+
+// buildClaim produces the distributedRecord to install for a fresh or
+// reclaimed lease. A reclaimed record gets IdempotencyManager.Start's retry
+// bookkeeping: a new StartedAt, IdempotencyInProgress, AttemptNumber
+// incremented, CompletedAt and Error cleared. If the previous lease expired
+// while IdempotencyInProgress, the returned record does not show that
+// attempt as IdempotencyFailed and carries no error for it.
+func (s *DistributedStore) buildClaim(existing *distributedRecord, key string, requestData interface{}, now time.Time, leaseTTL time.Duration) *distributedRecord {
+	if existing == nil {
+		record := &IdempotencyRecord{
+			Key:           key,
+			RequestHash:   hashData(requestData),
+			CreatedAt:     now,
+			StartedAt:     &now,
+			Status:        IdempotencyInProgress,
+			AttemptNumber: 1,
+			FileChanges:   []FileChangeRecord{},
+			Metadata:      make(map[string]string),
+		}
+		return &distributedRecord{Record: record, LeaseExpiresAt: now.Add(leaseTTL)}
+	}
+
+	record := existing.Record
+	if record.Status == IdempotencyInProgress && existing.leaseExpired(now) {
+		// The replica holding this lease is presumed dead: the operation
+		// never reached Complete. Status, Error and CompletedAt set here are
+		// overwritten just below as the new attempt starts, so the stored
+		// record keeps neither the failed status nor this error.
+		record.Status = IdempotencyFailed
+		record.Success = false
+		record.Error = "lease expired: holder did not complete or refresh in time"
+		record.CompletedAt = &now
+	}
+
+	record.StartedAt = &now
+	record.Status = IdempotencyInProgress
+	record.AttemptNumber++
+	record.CompletedAt = nil
+	record.Error = ""
+
+	return &distributedRecord{Record: record, LeaseExpiresAt: now.Add(leaseTTL)}
+}
+
+// Refresh extends the lease on an in-progress record. Call this from a
+// heartbeat goroutine (see Heartbeat) for the duration of the operation so a
+// live replica never loses its lease to a false reclaim.
+func (s *DistributedStore) Refresh(key string, leaseTTL time.Duration) error {
+	raw, err := s.backend.Load(key)
+	if err != nil {
+		return fmt.Errorf("idempotency: load %q: %w", key, err)
+	}
+	if raw == nil {
+		return fmt.Errorf("idempotency: refresh %q: %w", key, ErrLeaseHeld)
+	}
+
+	existing, err := decodeDistributedRecord(raw)
+	if err != nil {
+		return err
+	}
+	if existing.Record.Status != IdempotencyInProgress {
+		return fmt.Errorf("idempotency: refresh %q: %w", key, ErrLeaseHeld)
+	}
+
+	existing.LeaseExpiresAt = time.Now().Add(leaseTTL)
+	nextBytes, err := json.Marshal(existing)
+	if err != nil {
+		return fmt.Errorf("idempotency: encode %q: %w", key, err)
+	}
+
+	ok, err := s.backend.CompareAndStore(key, raw, nextBytes)
+	if err != nil {
+		return fmt.Errorf("idempotency: refresh %q: %w", key, err)
+	}
+	if !ok {
+		return fmt.Errorf("idempotency: refresh %q: %w", key, ErrLeaseHeld)
+	}
+	return nil
+}
+
+// Heartbeat starts a goroutine that calls Refresh at interval until done is
+// closed, and returns a function to stop it early. If a refresh fails
+// (another replica reclaimed the lease), onLost is invoked and the
+// goroutine exits.
+func (s *DistributedStore) Heartbeat(key string, leaseTTL, interval time.Duration, onLost func(error)) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.Refresh(key, leaseTTL); err != nil {
+					if onLost != nil {
+						onLost(err)
+					}
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Complete marks the operation as finished and releases the lease so
+// waiters (if any) can be notified.
+func (s *DistributedStore) Complete(key string, success bool, result interface{}, err error) error {
+	raw, loadErr := s.backend.Load(key)
+	if loadErr != nil {
+		return fmt.Errorf("idempotency: load %q: %w", key, loadErr)
+	}
+	if raw == nil {
+		return nil
+	}
+
+	existing, decodeErr := decodeDistributedRecord(raw)
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	now := time.Now()
+	existing.Record.CompletedAt = &now
+	existing.Record.Success = success
+	if success {
+		existing.Record.Status = IdempotencyCompleted
+		if result != nil {
+			existing.Record.ResultHash = hashData(result)
+		}
+	} else {
+		existing.Record.Status = IdempotencyFailed
+		if err != nil {
+			existing.Record.Error = err.Error()
+		}
+	}
+	existing.LeaseExpiresAt = time.Time{}
+
+	nextBytes, marshalErr := json.Marshal(existing)
+	if marshalErr != nil {
+		return fmt.Errorf("idempotency: encode %q: %w", key, marshalErr)
+	}
+
+	ok, storeErr := s.backend.CompareAndStore(key, raw, nextBytes)
+	if storeErr != nil {
+		return fmt.Errorf("idempotency: complete %q: %w", key, storeErr)
+	}
+	if !ok {
+		return fmt.Errorf("idempotency: complete %q: record changed concurrently", key)
+	}
+
+	if s.waiter != nil {
+		_ = s.waiter.Publish(IdempotencyLeaseEvent{Key: key, Status: existing.Record.Status})
+	}
+	return nil
+}
+
+// Delete removes key from the backend entirely.
+func (s *DistributedStore) Delete(key string) error {
+	return s.backend.Delete(key)
+}
+
+// updateRecord atomically applies mutate to the record stored for key,
+// retrying on a lost compare-and-store race the same way Claim does, and
+// returns the record as it was left after mutate ran.
+func (s *DistributedStore) updateRecord(key string, mutate func(record *IdempotencyRecord)) (*IdempotencyRecord, error) {
+	for attempt := 0; attempt < s.claimRetries; attempt++ {
+		raw, err := s.backend.Load(key)
+		if err != nil {
+			return nil, fmt.Errorf("idempotency: load %q: %w", key, err)
+		}
+		if raw == nil {
+			return nil, fmt.Errorf("idempotency: update %q: no record", key)
+		}
+
+		existing, err := decodeDistributedRecord(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		mutate(existing.Record)
+
+		nextBytes, err := json.Marshal(existing)
+		if err != nil {
+			return nil, fmt.Errorf("idempotency: encode %q: %w", key, err)
+		}
+
+		ok, err := s.backend.CompareAndStore(key, raw, nextBytes)
+		if err != nil {
+			return nil, fmt.Errorf("idempotency: update %q: %w", key, err)
+		}
+		if ok {
+			return existing.Record, nil
+		}
+		// Lost the race - reload and retry against the latest value.
+	}
+
+	return nil, fmt.Errorf("idempotency: update %q: exhausted retries", key)
+}
+
+// RecordFileChange appends change to key's FileChanges in the backend.
+func (s *DistributedStore) RecordFileChange(key string, change FileChangeRecord) (*IdempotencyRecord, error) {
+	return s.updateRecord(key, func(record *IdempotencyRecord) {
+		record.FileChanges = append(record.FileChanges, change)
+	})
+}
+
+// MarkFileChangeApplied marks the first unapplied file change at path as
+// applied in the backend.
+func (s *DistributedStore) MarkFileChangeApplied(key string, path string) (*IdempotencyRecord, error) {
+	return s.updateRecord(key, func(record *IdempotencyRecord) {
+		now := time.Now()
+		for i := range record.FileChanges {
+			if record.FileChanges[i].Path == path && !record.FileChanges[i].Applied {
+				record.FileChanges[i].Applied = true
+				record.FileChanges[i].AppliedAt = &now
+				break
+			}
+		}
+	})
+}
+
+// WaitForCompletion blocks until key reaches a terminal status (completed,
+// failed, or rolled back) or timeout elapses, and returns the record at
+// that point. Call this after Claim returns ErrLeaseHeld instead of busy
+// polling Get: if the store was built with a LeaseWaiter, WaitForCompletion
+// subscribes to its pub/sub (Redis pub/sub, Postgres LISTEN/NOTIFY, ...) and
+// wakes as soon as the lease holder calls Complete; otherwise it falls back
+// to polling Get at pollInterval.
+func (s *DistributedStore) WaitForCompletion(key string, timeout, pollInterval time.Duration) (*IdempotencyRecord, error) {
+	deadline := time.Now().Add(timeout)
+
+	// Always check first: the record may already be terminal, or may
+	// become terminal between here and Subscribe taking effect.
+	if record, err := s.checkTerminal(key); err != nil || record != nil {
+		return record, err
+	}
+
+	if s.waiter == nil {
+		return s.pollForCompletion(key, deadline, pollInterval)
+	}
+
+	events, unsubscribe, err := s.waiter.Subscribe()
+	if err != nil {
+		return s.pollForCompletion(key, deadline, pollInterval)
+	}
+	defer unsubscribe()
+
+	// Re-check after subscribing in case Complete ran in the window between
+	// the first checkTerminal and Subscribe taking effect.
+	if record, err := s.checkTerminal(key); err != nil || record != nil {
+		return record, err
+	}
+
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return s.Get(key)
+		}
+
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return s.pollForCompletion(key, deadline, pollInterval)
+			}
+			if event.Key != key {
+				continue
+			}
+			return s.Get(key)
+		case <-time.After(remaining):
+			return s.Get(key)
+		}
+	}
+}
+
+// checkTerminal returns (record, nil) if key already has a terminal status,
+// (nil, nil) if it exists but is still in progress, or (nil, err) on a
+// backend error.
+func (s *DistributedStore) checkTerminal(key string) (*IdempotencyRecord, error) {
+	record, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil && record.Status != IdempotencyInProgress {
+		return record, nil
+	}
+	return nil, nil
+}
+
+func (s *DistributedStore) pollForCompletion(key string, deadline time.Time, pollInterval time.Duration) (*IdempotencyRecord, error) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if record, err := s.checkTerminal(key); err != nil || record != nil {
+			return record, err
+		}
+		if time.Now().After(deadline) {
+			return s.Get(key)
+		}
+		<-ticker.C
+	}
+}
+
+// =============================================================================
+// IdempotencyManager WRITE-THROUGH CACHE
+// =============================================================================
+//
+// These methods back IdempotencyManager.Check/Start/Complete when the
+// manager was built with NewIdempotencyManagerWithStore. The local map is
+// kept as a cache purely so Get/GetStats/GetAppliedChanges etc. have
+// something to read without a round trip; dist is always consulted for the
+// authoritative status.
+
+func (m *IdempotencyManager) checkDistributed(key string, requestData interface{}) IdempotencyCheckResult {
+	record, err := m.dist.Get(key)
+	if err != nil {
+		// The backend is unreachable: fail closed rather than risk a
+		// duplicate irreversible write across replicas.
+		return IdempotencyCheckResult{
+			IsDuplicate:   true,
+			ShouldProceed: false,
+			Reason:        fmt.Sprintf("distributed store unavailable: %v", err),
+		}
+	}
+	if record == nil {
+		return IdempotencyCheckResult{IsDuplicate: false, ShouldProceed: true, Reason: "new operation"}
+	}
+
+	m.cacheRecord(key, record)
+
+	if record.RequestHash != hashData(requestData) {
+		return IdempotencyCheckResult{IsDuplicate: false, ShouldProceed: true, Reason: "different request with same key"}
+	}
+
+	var result IdempotencyCheckResult
+	switch record.Status {
+	case IdempotencyCompleted:
+		if record.Success {
+			result = IdempotencyCheckResult{IsDuplicate: true, Record: record, ShouldProceed: false, Reason: "operation already completed successfully"}
+		} else {
+			result = IdempotencyCheckResult{IsDuplicate: true, Record: record, ShouldProceed: true, Reason: "previous attempt failed, retry allowed"}
+		}
+	case IdempotencyInProgress:
+		result = IdempotencyCheckResult{IsDuplicate: true, Record: record, ShouldProceed: false, Reason: "operation currently in progress on another replica"}
+	default:
+		result = IdempotencyCheckResult{IsDuplicate: true, Record: record, ShouldProceed: true, Reason: "previous attempt did not complete successfully, retry allowed"}
+	}
+
+	m.mu.RLock()
+	onDuplicate := m.onDuplicate
+	m.mu.RUnlock()
+	if onDuplicate != nil {
+		onDuplicate(key, record)
+	}
+
+	return result
+}
+
+func (m *IdempotencyManager) startDistributed(key string, requestData interface{}) (*IdempotencyRecord, error) {
+	record, err := m.dist.Claim(key, requestData, m.leaseTTL)
+	if err != nil {
+		if record != nil {
+			m.cacheRecord(key, record)
+		}
+		return record, err
+	}
+
+	m.cacheRecord(key, record)
+
+	// onLost is nil: if the lease is reclaimed mid-operation, Complete (if
+	// this replica still calls it) will simply no-op once it's no longer
+	// the lease holder, so there's nothing to react to here.
+	stop := m.dist.Heartbeat(key, m.leaseTTL, m.heartbeatInterval, nil)
+
+	m.mu.Lock()
+	m.heartbeatStops[key] = stop
+	m.mu.Unlock()
+
+	return record, nil
+}
+
+func (m *IdempotencyManager) completeDistributed(key string, success bool, result interface{}, err error) {
+	m.mu.Lock()
+	if stop, ok := m.heartbeatStops[key]; ok {
+		stop()
+		delete(m.heartbeatStops, key)
+	}
+	m.mu.Unlock()
+
+	if completeErr := m.dist.Complete(key, success, result, err); completeErr == nil {
+		if record, getErr := m.dist.Get(key); getErr == nil && record != nil {
+			m.cacheRecord(key, record)
+
+			m.mu.RLock()
+			onComplete := m.onComplete
+			m.mu.RUnlock()
+			if onComplete != nil {
+				copy := *record
+				onComplete(&copy)
+			}
+		}
+	}
+}
+
+// cacheRecord updates the local write-through cache with the authoritative
+// record fetched from dist, and runs it through the same LRU bookkeeping
+// as the in-memory path. NewIdempotencyManagerWithStore sets maxRecords to
+// 0, so on that path evict never drops anything and the cache is unbounded.
+func (m *IdempotencyManager) cacheRecord(key string, record *IdempotencyRecord) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store[key] = record
+	m.lastAccessedAt[key] = time.Now()
+	m.evict()
+}
+
+func decodeDistributedRecord(raw []byte) (*distributedRecord, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, nil
+	}
+	var dr distributedRecord
+	if err := json.Unmarshal(raw, &dr); err != nil {
+		return nil, fmt.Errorf("idempotency: decode record: %w", err)
+	}
+	return &dr, nil
+}
@@ -0,0 +1,336 @@
+package shared
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryBackend is a minimal in-process stand-in for a Redis/Postgres
+// DistributedStoreBackend, used to exercise DistributedStore's CAS logic
+// without a real datastore.
+type memoryBackend struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{data: make(map[string][]byte)}
+}
+
+func (b *memoryBackend) Load(key string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.data[key], nil
+}
+
+func (b *memoryBackend) CompareAndStore(key string, expected, data []byte) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, exists := b.data[key]
+	if expected == nil {
+		if exists {
+			return false, nil
+		}
+	} else if !exists || string(current) != string(expected) {
+		return false, nil
+	}
+
+	b.data[key] = data
+	return true, nil
+}
+
+func (b *memoryBackend) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.data, key)
+	return nil
+}
+
+func TestDistributedStore_ClaimAndComplete(t *testing.T) {
+	store := NewDistributedStore(newMemoryBackend(), nil)
+
+	record, err := store.Claim("key1", map[string]string{"foo": "bar"}, time.Minute)
+	if err != nil {
+		t.Fatalf("Claim returned error: %v", err)
+	}
+	if record.Status != IdempotencyInProgress {
+		t.Errorf("Status = %s, want in_progress", record.Status)
+	}
+
+	if err := store.Complete("key1", true, "result", nil); err != nil {
+		t.Fatalf("Complete returned error: %v", err)
+	}
+
+	got, err := store.Get("key1")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if got.Status != IdempotencyCompleted || !got.Success {
+		t.Errorf("record after Complete = %+v, want completed/success", got)
+	}
+}
+
+func TestDistributedStore_ClaimHeldByAnotherReplica(t *testing.T) {
+	store := NewDistributedStore(newMemoryBackend(), nil)
+
+	if _, err := store.Claim("key1", nil, time.Minute); err != nil {
+		t.Fatalf("first Claim returned error: %v", err)
+	}
+
+	_, err := store.Claim("key1", nil, time.Minute)
+	if err != ErrLeaseHeld {
+		t.Errorf("second Claim err = %v, want ErrLeaseHeld", err)
+	}
+}
+
+func TestDistributedStore_ReclaimsExpiredLease(t *testing.T) {
+	store := NewDistributedStore(newMemoryBackend(), nil)
+
+	if _, err := store.Claim("key1", nil, 1*time.Millisecond); err != nil {
+		t.Fatalf("first Claim returned error: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	record, err := store.Claim("key1", nil, time.Minute)
+	if err != nil {
+		t.Fatalf("reclaim after expiry returned error: %v", err)
+	}
+	if record.AttemptNumber != 2 {
+		t.Errorf("AttemptNumber after reclaim = %d, want 2", record.AttemptNumber)
+	}
+}
+
+func TestDistributedStore_RefreshExtendsLease(t *testing.T) {
+	store := NewDistributedStore(newMemoryBackend(), nil)
+
+	if _, err := store.Claim("key1", nil, 5*time.Millisecond); err != nil {
+		t.Fatalf("Claim returned error: %v", err)
+	}
+
+	if err := store.Refresh("key1", time.Minute); err != nil {
+		t.Fatalf("Refresh returned error: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Without the refresh the lease would have expired by now and Claim
+	// would succeed; with it, the lease is still live.
+	_, err := store.Claim("key1", nil, time.Minute)
+	if err != ErrLeaseHeld {
+		t.Errorf("Claim err = %v, want ErrLeaseHeld (refreshed lease should still be live)", err)
+	}
+}
+
+func TestIdempotencyManager_DistributedStart_LeaseHeld(t *testing.T) {
+	store := NewDistributedStore(newMemoryBackend(), nil)
+	m := NewIdempotencyManagerWithStore(time.Hour, store, time.Minute, 10*time.Second)
+
+	if _, err := m.Start("key1", nil); err != nil {
+		t.Fatalf("first Start returned error: %v", err)
+	}
+
+	_, err := m.Start("key1", nil)
+	if err != ErrLeaseHeld {
+		t.Errorf("second Start err = %v, want ErrLeaseHeld", err)
+	}
+}
+
+// fakeWaiter is an in-process LeaseWaiter stand-in for tests, playing the
+// role a RedisLeaseWaiter/Postgres LISTEN-NOTIFY waiter would in production.
+type fakeWaiter struct {
+	mu   sync.Mutex
+	subs []chan IdempotencyLeaseEvent
+}
+
+func (w *fakeWaiter) Publish(event IdempotencyLeaseEvent) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ch := range w.subs {
+		ch <- event
+	}
+	return nil
+}
+
+func (w *fakeWaiter) Subscribe() (<-chan IdempotencyLeaseEvent, func(), error) {
+	ch := make(chan IdempotencyLeaseEvent, 1)
+	w.mu.Lock()
+	w.subs = append(w.subs, ch)
+	w.mu.Unlock()
+
+	unsubscribe := func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for i, s := range w.subs {
+			if s == ch {
+				w.subs = append(w.subs[:i], w.subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, unsubscribe, nil
+}
+
+func TestDistributedStore_WaitForCompletion_WakesOnPublish(t *testing.T) {
+	waiter := &fakeWaiter{}
+	store := NewDistributedStore(newMemoryBackend(), waiter)
+
+	if _, err := store.Claim("key1", nil, time.Minute); err != nil {
+		t.Fatalf("Claim returned error: %v", err)
+	}
+
+	done := make(chan *IdempotencyRecord, 1)
+	go func() {
+		record, err := store.WaitForCompletion("key1", time.Second, 10*time.Millisecond)
+		if err != nil {
+			t.Errorf("WaitForCompletion returned error: %v", err)
+		}
+		done <- record
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := store.Complete("key1", true, nil, nil); err != nil {
+		t.Fatalf("Complete returned error: %v", err)
+	}
+
+	select {
+	case record := <-done:
+		if record == nil || record.Status != IdempotencyCompleted {
+			t.Errorf("record = %+v, want completed", record)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForCompletion did not wake up after Complete/Publish")
+	}
+}
+
+func TestDistributedStore_WaitForCompletion_PollsWithoutWaiter(t *testing.T) {
+	store := NewDistributedStore(newMemoryBackend(), nil)
+
+	if _, err := store.Claim("key1", nil, time.Minute); err != nil {
+		t.Fatalf("Claim returned error: %v", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = store.Complete("key1", true, nil, nil)
+	}()
+
+	record, err := store.WaitForCompletion("key1", time.Second, 5*time.Millisecond)
+	if err != nil {
+		t.Fatalf("WaitForCompletion returned error: %v", err)
+	}
+	if record == nil || record.Status != IdempotencyCompleted {
+		t.Errorf("record = %+v, want completed", record)
+	}
+}
+
+func TestIdempotencyManager_DistributedCheck_IncrementsDuplicateCounter(t *testing.T) {
+	store := NewDistributedStore(newMemoryBackend(), nil)
+	m := NewIdempotencyManagerWithStore(time.Hour, store, time.Minute, 10*time.Second)
+	c := NewCollector(m)
+
+	key := "key1"
+	data := map[string]string{"foo": "bar"}
+
+	if _, err := m.Start(key, data); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	// Checking while in progress on "another replica" should count as a
+	// duplicate even though the record lives in the distributed store.
+	m.Check(key, data)
+
+	if got := counterValue(c.duplicates); got != 1 {
+		t.Errorf("duplicates counter = %v, want 1", got)
+	}
+}
+
+func TestIdempotencyManager_DistributedCheckAndComplete(t *testing.T) {
+	store := NewDistributedStore(newMemoryBackend(), nil)
+	m := NewIdempotencyManagerWithStore(time.Hour, store, time.Minute, 10*time.Second)
+
+	key := "key1"
+	data := map[string]string{"foo": "bar"}
+
+	if _, err := m.Start(key, data); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	result := m.Check(key, data)
+	if result.ShouldProceed {
+		t.Error("Should not proceed while in progress on another replica")
+	}
+
+	m.Complete(key, true, "result", nil)
+
+	result = m.Check(key, data)
+	if result.ShouldProceed {
+		t.Error("Should not proceed after successful completion")
+	}
+}
+
+func TestIdempotencyManager_DistributedStart_HeartbeatKeepsLeaseAlive(t *testing.T) {
+	store := NewDistributedStore(newMemoryBackend(), nil)
+	m := NewIdempotencyManagerWithStore(time.Hour, store, 10*time.Millisecond, 2*time.Millisecond)
+
+	if _, err := m.Start("key1", nil); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	// Without the manager's heartbeat actually refreshing the lease in
+	// dist, it would expire well within this window and the lease would
+	// be reclaimable.
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := store.Claim("key1", nil, time.Minute); err != ErrLeaseHeld {
+		t.Errorf("Claim err = %v, want ErrLeaseHeld (heartbeat should keep the lease alive)", err)
+	}
+}
+
+func TestIdempotencyManager_DistributedFileChange_PersistsThroughStore(t *testing.T) {
+	store := NewDistributedStore(newMemoryBackend(), nil)
+	m := NewIdempotencyManagerWithStore(time.Hour, store, time.Minute, 10*time.Second)
+
+	key := "key1"
+	data := map[string]string{"foo": "bar"}
+
+	if _, err := m.Start(key, data); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	m.RecordFileChange(key, FileChangeRecord{Path: "/tmp/a.txt", Operation: IdempotentFileOpCreate})
+	m.MarkFileChangeApplied(key, "/tmp/a.txt")
+
+	// Check re-fetches the authoritative record from dist and re-caches it
+	// locally - if file-change bookkeeping weren't persisted to dist, this
+	// would clobber the applied state recorded above.
+	m.Check(key, data)
+
+	if !m.HasAppliedChanges(key) {
+		t.Error("applied file change should survive a Check round trip against the distributed store")
+	}
+}
+
+func TestIdempotencyManager_DistributedRemove_DeletesFromStore(t *testing.T) {
+	store := NewDistributedStore(newMemoryBackend(), nil)
+	m := NewIdempotencyManagerWithStore(time.Hour, store, time.Minute, 10*time.Second)
+
+	key := "key1"
+	if _, err := m.Start(key, nil); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	m.Complete(key, true, nil, nil)
+
+	m.Remove(key)
+
+	record, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if record != nil {
+		t.Errorf("record = %+v, want nil after Remove against a distributed store", record)
+	}
+}
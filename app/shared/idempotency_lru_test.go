@@ -0,0 +1,102 @@
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue reads the current value of a prometheus.Counter without
+// pulling in the (larger) prometheus/testutil package just for this.
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestIdempotencyManager_LRUEvictsCompletedRecords(t *testing.T) {
+	m := NewIdempotencyManager(time.Hour, 2)
+
+	for _, key := range []string{"key1", "key2"} {
+		if _, err := m.Start(key, nil); err != nil {
+			t.Fatalf("Start(%s) returned error: %v", key, err)
+		}
+		m.Complete(key, true, nil, nil)
+	}
+
+	// Touch key1 so it's more recently accessed than key2.
+	m.Get("key1")
+
+	if _, err := m.Start("key3", nil); err != nil {
+		t.Fatalf("Start(key3) returned error: %v", err)
+	}
+
+	if m.Get("key2") != nil {
+		t.Error("key2 should have been LRU-evicted")
+	}
+	if m.Get("key1") == nil {
+		t.Error("key1 should survive eviction (more recently accessed)")
+	}
+	if m.Get("key3") == nil {
+		t.Error("key3 should exist (just started)")
+	}
+}
+
+func TestIdempotencyManager_LRUNeverEvictsInProgress(t *testing.T) {
+	m := NewIdempotencyManager(time.Hour, 1)
+
+	if _, err := m.Start("key1", nil); err != nil {
+		t.Fatalf("Start(key1) returned error: %v", err)
+	}
+	// key1 is left in progress (never completed).
+
+	if _, err := m.Start("key2", nil); err != nil {
+		t.Fatalf("Start(key2) returned error: %v", err)
+	}
+
+	if m.Get("key1") == nil {
+		t.Error("in-progress key1 should never be evicted, even over the cap")
+	}
+	if m.Get("key2") == nil {
+		t.Error("key2 should exist")
+	}
+}
+
+func TestIdempotencyManager_LRUNeverEvictsUnappliedFileChanges(t *testing.T) {
+	m := NewIdempotencyManager(time.Hour, 1)
+
+	if _, err := m.Start("key1", nil); err != nil {
+		t.Fatalf("Start(key1) returned error: %v", err)
+	}
+	m.RecordFileChange("key1", FileChangeRecord{Path: "/tmp/a.txt", Operation: IdempotentFileOpCreate, Applied: false})
+	m.Complete("key1", true, nil, nil)
+
+	if _, err := m.Start("key2", nil); err != nil {
+		t.Fatalf("Start(key2) returned error: %v", err)
+	}
+
+	if m.Get("key1") == nil {
+		t.Error("key1 has an unapplied file change and should never be evicted")
+	}
+}
+
+func TestCollector_ReportsStatsAndDuplicates(t *testing.T) {
+	m := NewIdempotencyManager(time.Hour, 0)
+	c := NewCollector(m)
+
+	if _, err := m.Start("key1", "data"); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	m.Complete("key1", true, nil, nil)
+
+	// Duplicate check should increment the counter wired up by NewCollector.
+	m.Check("key1", "data")
+
+	if got := counterValue(c.duplicates); got != 1 {
+		t.Errorf("duplicates counter = %v, want 1", got)
+	}
+}
@@ -0,0 +1,111 @@
+package shared
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// =============================================================================
+// PROMETHEUS METRICS
+// =============================================================================
+//
+// Collector exposes IdempotencyManager's internal state to Prometheus so
+// operators can alert on it instead of having to poll GetStats() manually -
+// e.g. a page when InProgress stays elevated (a stuck replica holding a
+// lease) or when the duplicate counter spikes (a retry storm from a flaky
+// model provider).
+//
+// =============================================================================
+
+var idempotencyStatGaugeDesc = map[string]*prometheus.Desc{
+	"total":      prometheus.NewDesc("plandex_idempotency_records_total", "Total idempotency records currently tracked.", nil, nil),
+	"pending":    prometheus.NewDesc("plandex_idempotency_records_pending", "Idempotency records awaiting their first attempt.", nil, nil),
+	"inProgress": prometheus.NewDesc("plandex_idempotency_records_in_progress", "Idempotency records currently executing.", nil, nil),
+	"completed":  prometheus.NewDesc("plandex_idempotency_records_completed", "Idempotency records that completed successfully.", nil, nil),
+	"failed":     prometheus.NewDesc("plandex_idempotency_records_failed", "Idempotency records in a failed state.", nil, nil),
+	"retries":    prometheus.NewDesc("plandex_idempotency_retries_total", "Total retry attempts across all tracked records.", nil, nil),
+	"evicted":    prometheus.NewDesc("plandex_idempotency_records_evicted_total", "Records dropped by LRU eviction since startup.", nil, nil),
+}
+
+// Collector implements prometheus.Collector for an IdempotencyManager. It
+// wires itself into the manager's duplicate and completion callbacks, so
+// construct it once per manager (constructing a second Collector for the
+// same manager overwrites the first's callbacks).
+type Collector struct {
+	manager *IdempotencyManager
+
+	attempts   prometheus.Histogram
+	latency    prometheus.Histogram
+	duplicates prometheus.Counter
+}
+
+// NewCollector creates a Collector for manager and registers the callbacks
+// it needs to populate the attempt/latency histograms and duplicate
+// counter. Register the returned Collector with a prometheus.Registry to
+// start exporting it.
+func NewCollector(manager *IdempotencyManager) *Collector {
+	c := &Collector{
+		manager: manager,
+		attempts: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "plandex_idempotency_attempts_histogram",
+			Help:    "Distribution of attempt counts for idempotent operations reaching a terminal state.",
+			Buckets: []float64{1, 2, 3, 4, 5, 8, 13, 21},
+		}),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "plandex_idempotency_completion_latency_seconds_histogram",
+			Help:    "Distribution of time from an operation's most recent start to its completion.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		duplicates: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "plandex_idempotency_duplicates_total_counter",
+			Help: "Number of times Check found an operation already in flight or completed.",
+		}),
+	}
+
+	manager.SetCompletionCallback(c.observeCompletion)
+	manager.SetDuplicateCallback(func(string, *IdempotencyRecord) { c.duplicates.Inc() })
+
+	return c
+}
+
+func (c *Collector) observeCompletion(record *IdempotencyRecord) {
+	c.attempts.Observe(float64(record.AttemptNumber))
+
+	if record.StartedAt != nil && record.CompletedAt != nil {
+		c.latency.Observe(record.CompletedAt.Sub(*record.StartedAt).Seconds())
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range idempotencyStatGaugeDesc {
+		ch <- desc
+	}
+	c.attempts.Describe(ch)
+	c.latency.Describe(ch)
+	c.duplicates.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.manager.GetStats()
+
+	ch <- prometheus.MustNewConstMetric(idempotencyStatGaugeDesc["total"], prometheus.GaugeValue, float64(stats.TotalRecords))
+	ch <- prometheus.MustNewConstMetric(idempotencyStatGaugeDesc["pending"], prometheus.GaugeValue, float64(stats.PendingRecords))
+	ch <- prometheus.MustNewConstMetric(idempotencyStatGaugeDesc["inProgress"], prometheus.GaugeValue, float64(stats.InProgress))
+	ch <- prometheus.MustNewConstMetric(idempotencyStatGaugeDesc["completed"], prometheus.GaugeValue, float64(stats.CompletedRecords))
+	ch <- prometheus.MustNewConstMetric(idempotencyStatGaugeDesc["failed"], prometheus.GaugeValue, float64(stats.FailedRecords))
+	ch <- prometheus.MustNewConstMetric(idempotencyStatGaugeDesc["retries"], prometheus.GaugeValue, float64(stats.TotalRetries))
+	ch <- prometheus.MustNewConstMetric(idempotencyStatGaugeDesc["evicted"], prometheus.GaugeValue, float64(c.manager.evictedRecordCount()))
+
+	c.attempts.Collect(ch)
+	c.latency.Collect(ch)
+	c.duplicates.Collect(ch)
+}
+
+// evictedRecordCount returns the number of records the manager has dropped
+// via LRU eviction since it was created.
+func (m *IdempotencyManager) evictedRecordCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.evictedTotal
+}
@@ -0,0 +1,90 @@
+package shared
+
+import (
+	"errors"
+	"time"
+)
+
+// =============================================================================
+// DISTRIBUTED IDEMPOTENCY STORE
+// =============================================================================
+//
+// IdempotencyManager (idempotency.go) is per-process: two horizontally-scaled server
+// replicas retrying the same plan operation each keep their own map, so
+// nothing stops them both from executing the same irreversible file write.
+//
+// IdempotencyStore factors the storage concern out of IdempotencyManager so
+// it can be backed by something all replicas share (Redis, Postgres, ...).
+// DistributedStore (idempotency_distributed.go) is one such implementation; IdempotencyManager can
+// be layered in front of it as a write-through cache via
+// NewIdempotencyManagerWithStore.
+//
+// =============================================================================
+
+// ErrLeaseHeld is returned by Claim when another replica currently holds the
+// lease for a key.
+var ErrLeaseHeld = errors.New("idempotency: lease held by another replica")
+
+// IdempotencyStore is the storage backend for idempotency records. A
+// conforming implementation must make Claim atomic across all callers that
+// share the same backend, even across process boundaries.
+type IdempotencyStore interface {
+	// Claim atomically creates an IdempotencyInProgress record for key if
+	// none exists (or the existing lease has expired), and returns it. If a
+	// live lease is already held by another caller, it returns the current
+	// record alongside ErrLeaseHeld.
+	Claim(key string, requestData interface{}, leaseTTL time.Duration) (*IdempotencyRecord, error)
+
+	// Get returns the authoritative record for key, or nil if none exists.
+	Get(key string) (*IdempotencyRecord, error)
+
+	// Refresh extends the lease on an in-progress record, proving the
+	// claiming replica is still alive. It returns ErrLeaseHeld if the lease
+	// was reclaimed by another replica in the meantime.
+	Refresh(key string, leaseTTL time.Duration) error
+
+	// Complete marks an operation as finished (success or failure) and
+	// releases the lease.
+	Complete(key string, success bool, result interface{}, err error) error
+
+	// RecordFileChange atomically appends change to key's FileChanges and
+	// returns the updated record. Implementations must make this safe
+	// against a concurrent Refresh/Complete from the lease holder, since a
+	// lost update here would make an applied (irreversible) file change
+	// invisible to the next replica's eviction/retry decisions.
+	RecordFileChange(key string, change FileChangeRecord) (*IdempotencyRecord, error)
+
+	// MarkFileChangeApplied atomically marks the first unapplied file change
+	// at path as applied and returns the updated record.
+	MarkFileChangeApplied(key string, path string) (*IdempotencyRecord, error)
+
+	// Heartbeat starts a background goroutine that refreshes key's lease at
+	// interval until the returned stop func is called. onLost (may be nil)
+	// is invoked if a refresh ever fails, e.g. because another replica
+	// reclaimed the lease.
+	Heartbeat(key string, leaseTTL, interval time.Duration, onLost func(error)) (stop func())
+
+	// Delete removes a record entirely.
+	Delete(key string) error
+}
+
+// IdempotencyLeaseEvent is published when a record transitions to a terminal
+// state, so replicas blocked waiting on ErrLeaseHeld know to re-check.
+type IdempotencyLeaseEvent struct {
+	Key    string            `json:"key"`
+	Status IdempotencyStatus `json:"status"`
+}
+
+// LeaseWaiter lets a DistributedStore notify blocked callers without polling.
+// Backends that don't support pub/sub (LISTEN/NOTIFY, Redis pub/sub, ...) can
+// have Subscribe return an error or an already-closed channel, in which case
+// WaitForCompletion falls back to polling; a channel that stays open and
+// silent makes it wait out its full timeout instead.
+type LeaseWaiter interface {
+	// Publish announces that key has reached a terminal status.
+	Publish(event IdempotencyLeaseEvent) error
+
+	// Subscribe returns a channel of lease events and an unsubscribe func.
+	// The channel is closed once unsubscribe is called.
+	Subscribe() (events <-chan IdempotencyLeaseEvent, unsubscribe func(), err error)
+}
@@ -6,7 +6,7 @@ import (
 )
 
 func TestIdempotencyManager_NewOperation(t *testing.T) {
-	m := NewIdempotencyManager(1 * time.Hour)
+	m := NewIdempotencyManager(1 * time.Hour, 0)
 
 	key := "test-key-1"
 	data := map[string]string{"foo": "bar"}
@@ -22,13 +22,16 @@ func TestIdempotencyManager_NewOperation(t *testing.T) {
 }
 
 func TestIdempotencyManager_StartAndComplete(t *testing.T) {
-	m := NewIdempotencyManager(1 * time.Hour)
+	m := NewIdempotencyManager(1 * time.Hour, 0)
 
 	key := "test-key-2"
 	data := map[string]string{"foo": "bar"}
 
 	// Start the operation
-	record := m.Start(key, data)
+	record, err := m.Start(key, data)
+	if err != nil {
+		t.Fatalf("Start returned unexpected error: %v", err)
+	}
 	if record == nil {
 		t.Fatal("Start should return a record")
 	}
@@ -62,13 +65,13 @@ func TestIdempotencyManager_StartAndComplete(t *testing.T) {
 }
 
 func TestIdempotencyManager_FailedRetry(t *testing.T) {
-	m := NewIdempotencyManager(1 * time.Hour)
+	m := NewIdempotencyManager(1 * time.Hour, 0)
 
 	key := "test-key-3"
 	data := map[string]string{"foo": "bar"}
 
 	// Start and fail
-	m.Start(key, data)
+	_, _ = m.Start(key, data)
 	m.Complete(key, false, nil, &mockError{msg: "test error"})
 
 	// Check should allow retry
@@ -85,14 +88,14 @@ func TestIdempotencyManager_FailedRetry(t *testing.T) {
 }
 
 func TestIdempotencyManager_DifferentRequest(t *testing.T) {
-	m := NewIdempotencyManager(1 * time.Hour)
+	m := NewIdempotencyManager(1 * time.Hour, 0)
 
 	key := "test-key-4"
 	data1 := map[string]string{"foo": "bar"}
 	data2 := map[string]string{"foo": "baz"} // Different data
 
 	// Start with data1
-	m.Start(key, data1)
+	_, _ = m.Start(key, data1)
 	m.Complete(key, true, nil, nil)
 
 	// Check with different data should allow proceeding
@@ -106,10 +109,10 @@ func TestIdempotencyManager_DifferentRequest(t *testing.T) {
 }
 
 func TestIdempotencyManager_FileChangeTracking(t *testing.T) {
-	m := NewIdempotencyManager(1 * time.Hour)
+	m := NewIdempotencyManager(1 * time.Hour, 0)
 
 	key := "test-key-5"
-	m.Start(key, nil)
+	_, _ = m.Start(key, nil)
 
 	// Record file changes
 	m.RecordFileChange(key, FileChangeRecord{
@@ -151,10 +154,10 @@ func TestIdempotencyManager_FileChangeTracking(t *testing.T) {
 }
 
 func TestIdempotencyManager_Metadata(t *testing.T) {
-	m := NewIdempotencyManager(1 * time.Hour)
+	m := NewIdempotencyManager(1 * time.Hour, 0)
 
 	key := "test-key-6"
-	m.Start(key, nil)
+	_, _ = m.Start(key, nil)
 
 	// Set metadata
 	m.SetMetadata(key, "provider", "openai")
@@ -174,11 +177,11 @@ func TestIdempotencyManager_Metadata(t *testing.T) {
 }
 
 func TestIdempotencyManager_Cleanup(t *testing.T) {
-	m := NewIdempotencyManager(1 * time.Millisecond) // Very short TTL
+	m := NewIdempotencyManager(1 * time.Millisecond, 0) // Very short TTL
 
 	// Start some operations
-	m.Start("key1", nil)
-	m.Start("key2", nil)
+	_, _ = m.Start("key1", nil)
+	_, _ = m.Start("key2", nil)
 
 	// Wait for expiry
 	time.Sleep(5 * time.Millisecond)
@@ -199,10 +202,10 @@ func TestIdempotencyManager_Cleanup(t *testing.T) {
 }
 
 func TestIdempotencyManager_Clear(t *testing.T) {
-	m := NewIdempotencyManager(1 * time.Hour)
+	m := NewIdempotencyManager(1 * time.Hour, 0)
 
-	m.Start("key1", nil)
-	m.Start("key2", nil)
+	_, _ = m.Start("key1", nil)
+	_, _ = m.Start("key2", nil)
 
 	m.Clear()
 
@@ -215,18 +218,18 @@ func TestIdempotencyManager_Clear(t *testing.T) {
 }
 
 func TestIdempotencyManager_Stats(t *testing.T) {
-	m := NewIdempotencyManager(1 * time.Hour)
+	m := NewIdempotencyManager(1 * time.Hour, 0)
 
-	m.Start("key1", nil)
+	_, _ = m.Start("key1", nil)
 	m.Complete("key1", true, nil, nil)
 
-	m.Start("key2", nil)
+	_, _ = m.Start("key2", nil)
 	m.Complete("key2", false, nil, &mockError{msg: "error"})
 
-	m.Start("key3", nil) // Still in progress
+	_, _ = m.Start("key3", nil) // Still in progress
 
 	// Retry key2
-	m.Start("key2", nil)
+	_, _ = m.Start("key2", nil)
 
 	stats := m.GetStats()
 
@@ -282,13 +285,16 @@ func TestGenerateRequestIdempotencyKey(t *testing.T) {
 }
 
 func TestIdempotencyManager_RolledBackState(t *testing.T) {
-	m := NewIdempotencyManager(1 * time.Hour)
+	m := NewIdempotencyManager(1 * time.Hour, 0)
 
 	key := "test-key-rollback"
 	data := map[string]string{"foo": "bar"}
 
 	// Start the operation
-	record := m.Start(key, data)
+	record, err := m.Start(key, data)
+	if err != nil {
+		t.Fatalf("Start returned unexpected error: %v", err)
+	}
 	record.Status = IdempotencyRolledBack // Simulate rollback
 
 	// Check should allow retry after rollback
@@ -302,13 +308,13 @@ func TestIdempotencyManager_RolledBackState(t *testing.T) {
 }
 
 func TestIdempotencyManager_ExpiredRecord(t *testing.T) {
-	m := NewIdempotencyManager(1 * time.Millisecond) // Very short TTL
+	m := NewIdempotencyManager(1 * time.Millisecond, 0) // Very short TTL
 
 	key := "test-key-expired"
 	data := map[string]string{"foo": "bar"}
 
 	// Start and complete
-	m.Start(key, data)
+	_, _ = m.Start(key, data)
 	m.Complete(key, true, nil, nil)
 
 	// Wait for expiry